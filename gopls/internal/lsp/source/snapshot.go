@@ -7,6 +7,9 @@ package source
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"golang.org/x/tools/gopls/internal/file"
 	"golang.org/x/tools/gopls/internal/lsp/cache"
@@ -67,6 +70,118 @@ func WidestPackageForFile(ctx context.Context, snapshot *cache.Snapshot, uri pro
 	return selectPackageForFile(ctx, snapshot, uri, func(metas []*Metadata) *Metadata { return metas[len(metas)-1] })
 }
 
+// BuildConstraints describes a GOOS/GOARCH environment against which the
+// build-tag-qualified files of a package variant can be matched, analogous
+// to go/build.Context. A zero-value GOOS or GOARCH acts as a wildcard,
+// matching any value.
+//
+// BuildConstraints matches only the filename suffix convention (e.g.
+// "_linux.go", "_amd64.go"); it does not evaluate //go:build or // +build
+// comments, since that requires reading file content that callers selecting
+// among Metadata.GoFiles do not have. There is correspondingly no field for
+// arbitrary build tags.
+type BuildConstraints struct {
+	GOOS   string
+	GOARCH string
+}
+
+// PackageForFileMatching is a convenience function that selects, among the
+// non-ITV packages to which uri belongs, the one whose GoFiles best satisfy
+// constraints, type-checks it in the requested mode (full or workspace), and
+// returns it along with the parse tree of uri.
+//
+// This lets features such as hover, references, and code actions operate on
+// a user-chosen build variant of a file -- for example a file ending in
+// "_linux.go" that is a member of both a native build and a cross-compiled
+// view -- rather than always defaulting to the first variant the loader
+// returned. Intermediate test variants are excluded, exactly as in
+// NarrowestPackageForFile and WidestPackageForFile.
+//
+// PackageForFileMatching prefers the candidate with the fewest GoFiles
+// whose filename suffix disagrees with constraints, so a candidate that
+// matches constraints exactly wins when there is one; ties go to the
+// narrowest candidate, so that the result is deterministic. The zero value
+// of BuildConstraints matches every candidate equally and so behaves like
+// NarrowestPackageForFile.
+func PackageForFileMatching(ctx context.Context, snapshot *cache.Snapshot, uri protocol.DocumentURI, constraints BuildConstraints) (*cache.Package, *ParsedGoFile, error) {
+	return selectPackageForFile(ctx, snapshot, uri, func(metas []*Metadata) *Metadata {
+		best, bestMisses := metas[0], -1
+		for _, md := range metas {
+			if misses := len(md.GoFiles) - constraints.score(md); bestMisses < 0 || misses < bestMisses {
+				best, bestMisses = md, misses
+			}
+		}
+		return best
+	})
+}
+
+// score reports how well md's GoFiles are consistent with c, as a count of
+// the files whose GOOS/GOARCH filename suffix (e.g. "_linux", "_amd64",
+// "_linux_amd64") agrees with c. Files with no such suffix always agree.
+//
+// score does not consult //go:build or // +build comments: distinguishing
+// those requires reading file content, which callers that only have
+// Metadata.GoFiles available cannot do cheaply.
+func (c BuildConstraints) score(md *Metadata) int {
+	score := 0
+	for _, uri := range md.GoFiles {
+		if c.fileNameMatches(uri) {
+			score++
+		}
+	}
+	return score
+}
+
+// fileNameMatches reports whether uri's filename build-tag suffix is
+// consistent with c, following the same underscore-prefix rule as
+// go/build's goodOSArchFile: a suffix is only recognized when it is
+// introduced by an underscore, so "foo_linux.go" (and "_linux.go") is
+// constrained to linux but plain "linux.go" is not constrained at all.
+func (c BuildConstraints) fileNameMatches(uri protocol.DocumentURI) bool {
+	name := strings.TrimSuffix(filepath.Base(uri.Path()), ".go")
+	i := strings.Index(name, "_")
+	if i < 0 {
+		return true
+	}
+	parts := strings.Split(name[i:], "_") // parts[0] == "" (the text before the first "_")
+	if n := len(parts); n > 0 && parts[n-1] == "test" {
+		parts = parts[:n-1]
+	}
+	if n := len(parts); n >= 2 && knownOS[parts[n-2]] && knownArch[parts[n-1]] {
+		return (c.GOOS == "" || parts[n-2] == c.GOOS) &&
+			(c.GOARCH == "" || parts[n-1] == c.GOARCH)
+	}
+	if n := len(parts); n >= 1 && knownOS[parts[n-1]] {
+		return c.GOOS == "" || parts[n-1] == c.GOOS
+	}
+	if n := len(parts); n >= 1 && knownArch[parts[n-1]] {
+		return c.GOARCH == "" || parts[n-1] == c.GOARCH
+	}
+	return true
+}
+
+// knownOS and knownArch mirror the GOOS/GOARCH name sets in
+// go/build/syslist.go that go/build uses to recognize filename build-tag
+// suffixes such as "_linux" or "_amd64". Keep these in sync with that file
+// as new ports are added.
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true,
+		"freebsd": true, "hurd": true, "illumos": true, "ios": true,
+		"js": true, "linux": true, "nacl": true, "netbsd": true,
+		"openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+		"windows": true, "zos": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true,
+		"armbe": true, "arm64": true, "arm64be": true, "loong64": true,
+		"mips": true, "mips64": true, "mips64le": true, "mips64p32": true,
+		"mips64p32le": true, "mipsle": true, "ppc": true, "ppc64": true,
+		"ppc64le": true, "riscv": true, "riscv64": true, "s390": true,
+		"s390x": true, "sparc": true, "sparc64": true, "wasm": true,
+	}
+)
+
 func selectPackageForFile(ctx context.Context, snapshot *cache.Snapshot, uri protocol.DocumentURI, selector func([]*Metadata) *Metadata) (*cache.Package, *ParsedGoFile, error) {
 	metas, err := snapshot.MetadataForFile(ctx, uri)
 	if err != nil {
@@ -89,6 +204,68 @@ func selectPackageForFile(ctx context.Context, snapshot *cache.Snapshot, uri pro
 	return pkg, pgf, err
 }
 
+// PackageForFile bundles a type-checked package with the parse tree of one
+// of its files, as returned by PackagesForFiles.
+type PackageForFile struct {
+	Pkg *cache.Package
+	PGF *ParsedGoFile
+}
+
+// PackagesForFiles is a batched analog of NarrowestPackageForFile and
+// WidestPackageForFile for callers that operate on many files at once
+// (workspace-wide code actions, multi-file rename previews, bulk
+// diagnostics). Rather than resolving metadata and type-checking once per
+// file, it resolves metadata for every uri, groups the URIs by the package
+// ID that selector chooses for each, and issues a single
+// snapshot.TypeCheck call for all of the distinct package IDs -- letting the
+// cache parallelize and dedupe work that a per-file loop would serialize.
+//
+// selector is applied independently to each file's non-ITV candidate
+// metadata, exactly as in selectPackageForFile; pass the same selector used
+// by NarrowestPackageForFile or WidestPackageForFile to preserve their
+// narrowest/widest semantics across the batch.
+func PackagesForFiles(ctx context.Context, snapshot *cache.Snapshot, uris []protocol.DocumentURI, selector func([]*Metadata) *Metadata) (map[protocol.DocumentURI]PackageForFile, error) {
+	idForURI := make(map[protocol.DocumentURI]PackageID, len(uris))
+	var ids []PackageID
+	seen := make(map[PackageID]bool)
+	for _, uri := range uris {
+		metas, err := snapshot.MetadataForFile(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		metadata.RemoveIntermediateTestVariants(&metas)
+		if len(metas) == 0 {
+			return nil, fmt.Errorf("no package metadata for file %s", uri)
+		}
+		id := selector(metas).ID
+		idForURI[uri] = id
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	pkgs, err := snapshot.TypeCheck(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	pkgByID := make(map[PackageID]*cache.Package, len(pkgs))
+	for _, pkg := range pkgs {
+		pkgByID[pkg.Metadata().ID] = pkg
+	}
+
+	result := make(map[protocol.DocumentURI]PackageForFile, len(uris))
+	for _, uri := range uris {
+		pkg := pkgByID[idForURI[uri]]
+		pgf, err := pkg.File(uri)
+		if err != nil {
+			return nil, err // "can't happen"
+		}
+		result[uri] = PackageForFile{Pkg: pkg, PGF: pgf}
+	}
+	return result, nil
+}
+
 // A FileSource maps URIs to FileHandles.
 type FileSource interface {
 	// ReadFile returns the FileHandle for a given URI, either by
@@ -99,6 +276,104 @@ type FileSource interface {
 	ReadFile(ctx context.Context, uri protocol.DocumentURI) (file.Handle, error)
 }
 
+// A FilteringFileSource wraps a FileSource, adding the ability to ask for a
+// file's handle along with whether it is generated, per file.IsGenerated.
+// Since file.IsGenerated does a full read and comment scan, the result is
+// memoized per URI and content hash, so that repeated queries for an
+// unchanged file do not repeat the scan. Each query still reads the file
+// through the wrapped FileSource to learn its current hash.
+type FilteringFileSource struct {
+	delegate FileSource
+
+	mu    sync.Mutex
+	cache map[protocol.DocumentURI]generatedCacheEntry
+}
+
+type generatedCacheEntry struct {
+	hash      file.Hash
+	generated bool
+}
+
+// NewFilteringFileSource returns a FilteringFileSource that reads through to
+// delegate.
+func NewFilteringFileSource(delegate FileSource) *FilteringFileSource {
+	return &FilteringFileSource{
+		delegate: delegate,
+		cache:    make(map[protocol.DocumentURI]generatedCacheEntry),
+	}
+}
+
+// ReadFile implements FileSource.
+func (s *FilteringFileSource) ReadFile(ctx context.Context, uri protocol.DocumentURI) (file.Handle, error) {
+	return s.delegate.ReadFile(ctx, uri)
+}
+
+// ReadFileSkipGenerated returns the file.Handle for uri, along with whether
+// it is a generated file, per file.IsGenerated.
+func (s *FilteringFileSource) ReadFileSkipGenerated(ctx context.Context, uri protocol.DocumentURI) (file.Handle, bool, error) {
+	fh, err := s.delegate.ReadFile(ctx, uri)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hash := fh.Identity().Hash
+	s.mu.Lock()
+	entry, ok := s.cache[uri]
+	s.mu.Unlock()
+	if ok && entry.hash == hash {
+		return fh, entry.generated, nil
+	}
+
+	generated := file.IsGenerated(ctx, fh)
+
+	s.mu.Lock()
+	s.cache[uri] = generatedCacheEntry{hash: hash, generated: generated}
+	s.mu.Unlock()
+
+	return fh, generated, nil
+}
+
+// PackageForFileSkippingGenerated behaves like NarrowestPackageForFile and
+// WidestPackageForFile (according to selector), except that when several
+// non-ITV packages contain uri, it prefers the variant whose GoFiles
+// contain the fewest generated files, as determined by fsrc. selector
+// breaks any remaining ties, exactly as in the unfiltered APIs.
+//
+// This lets refactoring commands that apply to whole packages (e.g.
+// rename) avoid proposing edits to generated files such as .pb.go or
+// _string.go outputs, by preferring to type-check a non-generated variant
+// of the package when one exists.
+func PackageForFileSkippingGenerated(ctx context.Context, snapshot *cache.Snapshot, fsrc *FilteringFileSource, uri protocol.DocumentURI, selector func([]*Metadata) *Metadata) (*cache.Package, *ParsedGoFile, error) {
+	return selectPackageForFile(ctx, snapshot, uri, func(metas []*Metadata) *Metadata {
+		return selector(leastGenerated(ctx, fsrc, metas))
+	})
+}
+
+// leastGenerated returns the subset of metas whose GoFiles contain the
+// fewest generated files, as determined by fsrc, preserving their relative
+// order.
+func leastGenerated(ctx context.Context, fsrc *FilteringFileSource, metas []*Metadata) []*Metadata {
+	counts := make([]int, len(metas))
+	min := -1
+	for i, md := range metas {
+		for _, uri := range md.GoFiles {
+			if _, generated, err := fsrc.ReadFileSkipGenerated(ctx, uri); err == nil && generated {
+				counts[i]++
+			}
+		}
+		if min == -1 || counts[i] < min {
+			min = counts[i]
+		}
+	}
+	var best []*Metadata
+	for i, md := range metas {
+		if counts[i] == min {
+			best = append(best, md)
+		}
+	}
+	return best
+}
+
 type ParsedGoFile = parsego.File
 
 const (
@@ -0,0 +1,55 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"testing"
+
+	"golang.org/x/tools/gopls/internal/lsp/protocol"
+)
+
+func TestBuildConstraintsFileNameMatches(t *testing.T) {
+	tests := []struct {
+		file        string
+		constraints BuildConstraints
+		want        bool
+	}{
+		// A plain, unsuffixed name is never constrained.
+		{"foo.go", BuildConstraints{GOOS: "linux"}, true},
+
+		// A bare OS/ARCH name with no underscore prefix is not a suffix
+		// at all, per go/build's goodOSArchFile: "linux.go" is not
+		// equivalent to "foo_linux.go".
+		{"linux.go", BuildConstraints{GOOS: "windows"}, true},
+		{"arm64.go", BuildConstraints{GOARCH: "386"}, true},
+
+		// An underscore-prefixed OS suffix constrains to that OS.
+		{"foo_linux.go", BuildConstraints{GOOS: "linux"}, true},
+		{"foo_linux.go", BuildConstraints{GOOS: "windows"}, false},
+
+		// An underscore-prefixed OS_ARCH suffix constrains to both.
+		{"foo_linux_amd64.go", BuildConstraints{GOOS: "linux", GOARCH: "amd64"}, true},
+		{"foo_linux_amd64.go", BuildConstraints{GOOS: "linux", GOARCH: "arm64"}, false},
+
+		// A trailing "_test" does not itself participate in the suffix.
+		{"foo_linux_test.go", BuildConstraints{GOOS: "linux"}, true},
+		{"foo_linux_test.go", BuildConstraints{GOOS: "windows"}, false},
+
+		// The zero value matches everything, regardless of suffix.
+		{"foo_linux_amd64.go", BuildConstraints{}, true},
+
+		// knownOS/knownArch must include newer ports.
+		{"foo_wasip1.go", BuildConstraints{GOOS: "wasip1"}, true},
+		{"foo_wasip1.go", BuildConstraints{GOOS: "windows"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			uri := protocol.DocumentURI("file:///" + test.file)
+			if got := test.constraints.fileNameMatches(uri); got != test.want {
+				t.Errorf("BuildConstraints(%+v).fileNameMatches(%s) = %v, want %v", test.constraints, test.file, got, test.want)
+			}
+		})
+	}
+}